@@ -0,0 +1,64 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package cloudinit provides a small, typed subset of the #cloud-config
+// user-data format so that roachprod can inject boot-time configuration
+// (packages, files, commands) into VMs through each provider's native
+// user-data mechanism.
+package cloudinit
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// WriteFile describes a single entry in cloud-init's write_files module.
+type WriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Encoding    string `yaml:"encoding,omitempty"`
+}
+
+// User describes a single entry in cloud-init's users module.
+type User struct {
+	Name              string   `yaml:"name"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+	Sudo              string   `yaml:"sudo,omitempty"`
+}
+
+// Config is a typed subset of a #cloud-config document. It covers the
+// handful of modules roachprod test harnesses actually need at boot time;
+// anything more exotic should be expressed as a RunCmd entry instead of
+// growing this struct.
+type Config struct {
+	Packages   []string    `yaml:"packages,omitempty"`
+	WriteFiles []WriteFile `yaml:"write_files,omitempty"`
+	Users      []User      `yaml:"users,omitempty"`
+	RunCmd     []string    `yaml:"runcmd,omitempty"`
+}
+
+// Render marshals c into a #cloud-config document suitable for passing to
+// a provider's native user-data mechanism (GCE metadata.startup-script,
+// AWS EC2 UserData, Azure customData, vSphere guestinfo.userdata, etc).
+func (c *Config) Render() (string, error) {
+	body, err := yaml.Marshal(c)
+	if err != nil {
+		return "", errors.Wrap(err, "rendering cloud-init config")
+	}
+	return fmt.Sprintf("#cloud-config\n%s", body), nil
+}
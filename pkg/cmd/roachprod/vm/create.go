@@ -0,0 +1,140 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package vm
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// CreateCluster creates the VMs named by names, splitting them across
+// opts.VMProviders and fanning the per-provider Create calls out in
+// parallel. If any provider's Create fails, CreateCluster cancels the
+// shared context, so a provider whose Create has not started yet skips
+// it; Create calls already running are waited for. It then issues
+// compensating Delete calls against every dispatched provider for the
+// VMs that provider's List reports under the names it was given. A VM
+// that its provider's List does not report is not deleted. On success,
+// it returns the
+// fully-populated List by re-listing each provider and filtering down to
+// the names just created.
+func CreateCluster(names []string, opts CreateOpts) (List, error) {
+	if len(opts.VMProviders) == 0 {
+		return nil, errors.New("no VMProviders specified")
+	}
+
+	byProvider := splitNames(names, opts.VMProviders, opts.GeoDistributed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, ctx := errgroup.WithContext(ctx)
+	for providerName, providerNames := range byProvider {
+		providerName, providerNames := providerName, providerNames
+		if len(providerNames) == 0 {
+			continue
+		}
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := ForProvider(providerName, func(p Provider) error {
+				return p.Create(providerNames, opts)
+			}); err != nil {
+				return errors.Wrapf(err, "creating VMs on provider %s", providerName)
+			}
+			return nil
+		})
+	}
+
+	if createErr := g.Wait(); createErr != nil {
+		cancel()
+		// A provider that fans Create out per-node internally (as the
+		// vsphere and openstack providers do) can have produced some VMs
+		// before erroring, even though its own Create call returned an
+		// error. Re-list every dispatched provider rather than trusting
+		// which ones returned nil, so the VMs such a provider did create
+		// are deleted too.
+		if err := rollbackCreate(byProvider); err != nil {
+			return nil, errors.Wrapf(createErr, "cluster create failed and rollback also failed: %s", err)
+		}
+		return nil, createErr
+	}
+
+	var ret List
+	err := ProvidersSequential(opts.VMProviders, func(p Provider) error {
+		list, err := p.List()
+		if err != nil {
+			return err
+		}
+		ret = append(ret, list.filterNames(byProvider[p.Name()])...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// opts.PostCreateHook, if set, is already invoked by each provider's own
+	// Create implementation as soon as a VM has a reachable address, so it
+	// fires for every Provider.Create caller and not just CreateCluster;
+	// invoking it again here would double-fire it for vsphere and
+	// openstack, so CreateCluster does not call it itself.
+
+	return ret, nil
+}
+
+// rollbackCreate re-lists every provider named in byProvider and deletes
+// any VM matching the names that were dispatched to it, undoing a
+// partially-failed CreateCluster. It does this for all dispatched
+// providers, not just the ones whose Create call returned nil, since a
+// provider can create some nodes and then fail before Create returns.
+func rollbackCreate(byProvider map[string][]string) error {
+	var toRollback []string
+	for name := range byProvider {
+		toRollback = append(toRollback, name)
+	}
+
+	return ProvidersParallel(toRollback, func(p Provider) error {
+		list, err := p.List()
+		if err != nil {
+			return err
+		}
+		created := list.filterNames(byProvider[p.Name()])
+		if len(created) == 0 {
+			return nil
+		}
+		return p.Delete(created)
+	})
+}
+
+// splitNames divides names across providers. When geoDistributed is set,
+// names are assigned round-robin so each provider hosts a roughly equal,
+// interleaved share of the cluster; otherwise every name is assigned to
+// the first provider.
+func splitNames(names []string, providers []string, geoDistributed bool) map[string][]string {
+	ret := make(map[string][]string, len(providers))
+	if !geoDistributed {
+		ret[providers[0]] = names
+		return ret
+	}
+	for i, name := range names {
+		p := providers[i%len(providers)]
+		ret[p] = append(ret[p], name)
+	}
+	return ret
+}
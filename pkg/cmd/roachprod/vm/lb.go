@@ -0,0 +1,94 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package vm
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// LBEndpoint describes the stable address of a load balancer created via
+// LoadBalancer.EnsureLB.
+type LBEndpoint struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Ports   []int  `json:"ports"`
+}
+
+// LoadBalancer is an optional extension to Provider for providers that can
+// front a set of VMs with a native L4 load balancer. Callers discover
+// support for it by type-asserting a Provider, the same pattern used
+// elsewhere for optional, provider-specific capabilities.
+//
+// This checkout does not contain the gce or aws provider packages, so
+// LoadBalancer has no implementations here; EnsureLB/DeleteLB against
+// those providers will fail with "does not support load balancers" until
+// gce.Provider/aws.Provider grow EnsureLB/DescribeLB/DeleteLB methods
+// backed by their native L4 LBs (GCE forwarding rules / target pools,
+// AWS NLB).
+type LoadBalancer interface {
+	// EnsureLB creates the named load balancer if it does not already
+	// exist, or reconciles its backend pool to match vms if it does.
+	EnsureLB(name string, vms List, ports []int) (LBEndpoint, error)
+	// DescribeLB returns the current state of a load balancer previously
+	// created by EnsureLB.
+	DescribeLB(name string) (LBEndpoint, error)
+	// DeleteLB tears down the named load balancer.
+	DeleteLB(name string) error
+}
+
+// EnsureLB creates or reconciles a load balancer named `name` fronting vms.
+// When vms spans multiple providers, the call is dispatched to each
+// provider via FanOut and the per-provider endpoints are returned keyed by
+// provider name. A provider that does not implement LoadBalancer causes
+// the call to fail for the VMs it owns. No provider in this checkout
+// implements LoadBalancer (see the interface doc comment), so as of this
+// writing every EnsureLB call fails for every VM.
+func EnsureLB(name string, vms List, ports []int) (map[string]LBEndpoint, error) {
+	ret := map[string]LBEndpoint{}
+	var mu sync.Mutex
+
+	err := FanOut(vms, func(p Provider, list List) error {
+		lb, ok := p.(LoadBalancer)
+		if !ok {
+			return errors.Errorf("provider %q does not support load balancers", p.Name())
+		}
+		endpoint, err := lb.EnsureLB(name, list, ports)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		ret[p.Name()] = endpoint
+		mu.Unlock()
+		return nil
+	})
+	return ret, err
+}
+
+// DeleteLB tears down the load balancer named `name` on every provider
+// represented in vms. No provider in this checkout implements
+// LoadBalancer, so as of this writing every DeleteLB call fails for every
+// VM.
+func DeleteLB(name string, vms List) error {
+	return FanOut(vms, func(p Provider, list List) error {
+		lb, ok := p.(LoadBalancer)
+		if !ok {
+			return errors.Errorf("provider %q does not support load balancers", p.Name())
+		}
+		return lb.DeleteLB(name)
+	})
+}
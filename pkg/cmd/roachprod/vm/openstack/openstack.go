@@ -0,0 +1,531 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package openstack implements the vm.Provider interface against an
+// OpenStack Nova/Neutron deployment.
+package openstack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cmd/roachprod/config"
+	"github.com/cockroachdb/cockroach/pkg/cmd/roachprod/vm"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/startstop"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/sync/errgroup"
+)
+
+// ProviderName is the name associated with the OpenStack vm.Provider.
+const ProviderName = "openstack"
+
+// Server metadata keys used to track ownership and expiration, since Nova
+// has no native concept of an instance lifetime.
+const (
+	metaLifetime = "roachprod-lifetime"
+	metaCreated  = "roachprod-created"
+	metaUser     = "roachprod-user"
+)
+
+func init() {
+	vm.Providers[ProviderName] = &Provider{}
+}
+
+// providerOpts implements vm.ProviderFlags. The auth fields mirror the
+// standard OS_* environment variables so that a roachprod invocation can
+// reuse an operator's existing OpenStack RC file.
+type providerOpts struct {
+	AuthURL                     string
+	Username                    string
+	Password                    string
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+	ProjectName                 string
+	DomainName                  string
+	Region                      string
+
+	Flavor           string
+	Image            string
+	Network          string
+	SecurityGroups   []string
+	AvailabilityZone string
+	KeyName          string
+	FloatingIPPool   string
+}
+
+// Provider implements the vm.Provider interface for OpenStack.
+type Provider struct {
+	opts providerOpts
+}
+
+// ConfigureCreateFlags implements vm.ProviderFlags.
+func (p *Provider) ConfigureCreateFlags(flags *pflag.FlagSet) {
+}
+
+// ConfigureClusterFlags implements vm.ProviderFlags.
+func (p *Provider) ConfigureClusterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&p.opts.AuthURL, "openstack-auth-url", "",
+		"OpenStack identity (Keystone) auth URL, e.g. https://openstack.example.com:5000/v3")
+	flags.StringVar(&p.opts.Username, "openstack-username", "",
+		"OpenStack username")
+	flags.StringVar(&p.opts.Password, "openstack-password", "",
+		"OpenStack password")
+	flags.StringVar(&p.opts.ApplicationCredentialID, "openstack-application-credential-id", "",
+		"OpenStack application credential ID, used instead of username/password")
+	flags.StringVar(&p.opts.ApplicationCredentialSecret, "openstack-application-credential-secret", "",
+		"OpenStack application credential secret")
+	flags.StringVar(&p.opts.ProjectName, "openstack-project", "",
+		"OpenStack project (tenant) name")
+	flags.StringVar(&p.opts.DomainName, "openstack-domain", "Default",
+		"OpenStack domain name")
+	flags.StringVar(&p.opts.Region, "openstack-region", "",
+		"OpenStack region name")
+
+	flags.StringVar(&p.opts.Flavor, "openstack-flavor", "",
+		"OpenStack flavor (instance size) to launch")
+	flags.StringVar(&p.opts.Image, "openstack-image", "",
+		"OpenStack image to boot")
+	flags.StringVar(&p.opts.Network, "openstack-network", "",
+		"OpenStack (Neutron) network to attach")
+	flags.StringSliceVar(&p.opts.SecurityGroups, "openstack-security-groups", nil,
+		"OpenStack security groups to apply to new instances")
+	flags.StringVar(&p.opts.AvailabilityZone, "openstack-availability-zone", "",
+		"OpenStack availability zone to launch into")
+	flags.StringVar(&p.opts.KeyName, "openstack-key-name", "",
+		"OpenStack keypair name to inject into new instances")
+	flags.StringVar(&p.opts.FloatingIPPool, "openstack-floating-ip-pool", "",
+		"OpenStack floating IP pool (external network) to allocate instance public IPs from")
+}
+
+// Flags implements vm.Provider.
+func (p *Provider) Flags() vm.ProviderFlags {
+	return &p.opts
+}
+
+// Name implements vm.Provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// computeClient authenticates against Keystone and returns a Nova client.
+func (p *Provider) computeClient() (*gophercloud.ServiceClient, error) {
+	authOpts := gophercloud.AuthOptions{
+		IdentityEndpoint:            p.opts.AuthURL,
+		Username:                    p.opts.Username,
+		Password:                    p.opts.Password,
+		ApplicationCredentialID:     p.opts.ApplicationCredentialID,
+		ApplicationCredentialSecret: p.opts.ApplicationCredentialSecret,
+		TenantName:                  p.opts.ProjectName,
+		DomainName:                  p.opts.DomainName,
+	}
+	provider, err := openstack.AuthenticatedClient(authOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "authenticating with OpenStack")
+	}
+	return openstack.NewComputeV2(provider, gophercloud.EndpointOpts{Region: p.opts.Region})
+}
+
+// CleanSSH implements vm.Provider.
+func (p *Provider) CleanSSH() error {
+	return nil
+}
+
+// ConfigSSH implements vm.Provider.
+func (p *Provider) ConfigSSH() error {
+	return nil
+}
+
+// Create implements vm.Provider. Instances are created concurrently, one
+// per requested name, with the lifetime/owner metadata set at creation;
+// once each is ACTIVE a floating IP from the configured pool is
+// associated with it.
+func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+
+	account, err := p.FindActiveAccount()
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for i := range names {
+		name := names[i]
+		g.Go(func() error {
+			return p.createVM(client, name, account, opts)
+		})
+	}
+	return g.Wait()
+}
+
+func (p *Provider) createVM(
+	client *gophercloud.ServiceClient, name, account string, opts vm.CreateOpts,
+) error {
+	userData, err := opts.UserData.Render()
+	if err != nil {
+		return errors.Wrapf(err, "rendering user-data for %q", name)
+	}
+
+	createOpts := servers.CreateOpts{
+		Name:             name,
+		FlavorName:       p.opts.Flavor,
+		ImageName:        p.opts.Image,
+		AvailabilityZone: p.opts.AvailabilityZone,
+		SecurityGroups:   p.opts.SecurityGroups,
+		Networks:         []servers.Network{{UUID: p.opts.Network}},
+		UserData:         []byte(userData),
+		Metadata: map[string]string{
+			metaLifetime: opts.Lifetime.String(),
+			metaCreated:  timeNow().Format(time.RFC3339),
+			metaUser:     account,
+		},
+	}
+	keypairOpts := keypairs.CreateOptsExt{
+		CreateOptsBuilder: createOpts,
+		KeyName:           p.opts.KeyName,
+	}
+
+	server, err := servers.Create(client, keypairOpts).Extract()
+	if err != nil {
+		return errors.Wrapf(err, "creating instance %q", name)
+	}
+
+	if err := servers.WaitForStatus(client, server.ID, "ACTIVE", 600); err != nil {
+		return errors.Wrapf(err, "waiting for %q to become active", name)
+	}
+
+	fip, err := floatingips.Create(client, floatingips.CreateOpts{
+		Pool: p.opts.FloatingIPPool,
+	}).Extract()
+	if err != nil {
+		return errors.Wrapf(err, "allocating floating IP for %q", name)
+	}
+	if err := floatingips.AssociateInstance(client, server.ID, floatingips.AssociateOpts{
+		FloatingIP: fip.IP,
+	}).ExtractErr(); err != nil {
+		return errors.Wrapf(err, "associating floating IP with %q", name)
+	}
+
+	if opts.PostCreateHook != nil {
+		// Re-fetch the server so its Addresses map reflects the
+		// just-associated floating IP alongside the fixed address Nova
+		// assigned at boot.
+		detail, err := servers.Get(client, server.ID).Extract()
+		if err != nil {
+			return errors.Wrapf(err, "fetching instance %q", name)
+		}
+		privateIP, publicIP := addressesFromServer(detail.Addresses)
+		if err := opts.PostCreateHook(vm.VM{
+			Name:       name,
+			Provider:   ProviderName,
+			ProviderID: server.ID,
+			PublicIP:   publicIP,
+			PrivateIP:  privateIP,
+			RemoteUser: config.DefaultSSHUser,
+		}); err != nil {
+			return errors.Wrapf(err, "running post-create hook for %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Delete implements vm.Provider. Floating IPs are released before the
+// backing instance is destroyed so they return to the pool immediately.
+func (p *Provider) Delete(vms vm.List) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			pages, err := floatingips.List(client).AllPages()
+			if err != nil {
+				return err
+			}
+			all, err := floatingips.ExtractFloatingIPs(pages)
+			if err != nil {
+				return err
+			}
+			for _, fip := range all {
+				if fip.InstanceID == v.ProviderID {
+					if err := floatingips.DisassociateInstance(client, v.ProviderID, floatingips.DisassociateOpts{
+						FloatingIP: fip.IP,
+					}).ExtractErr(); err != nil {
+						return errors.Wrapf(err, "releasing floating IP from %q", v.Name)
+					}
+					if err := floatingips.Delete(client, fip.ID).ExtractErr(); err != nil {
+						return errors.Wrapf(err, "deleting floating IP for %q", v.Name)
+					}
+					break
+				}
+			}
+			return errors.Wrapf(
+				servers.Delete(client, v.ProviderID).ExtractErr(), "destroying %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// Extend implements vm.Provider.
+func (p *Provider) Extend(vms vm.List, lifetime time.Duration) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			_, err := servers.UpdateMetadata(client, v.ProviderID, servers.MetadataOpts{
+				metaLifetime: lifetime.String(),
+			}).Extract()
+			return errors.Wrapf(err, "extending %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// FindActiveAccount implements vm.Provider.
+func (p *Provider) FindActiveAccount() (string, error) {
+	if p.opts.Username != "" {
+		return p.opts.Username, nil
+	}
+	return p.opts.ApplicationCredentialID, nil
+}
+
+// List implements vm.Provider. It filters the Nova server list down to
+// those carrying the roachprod metadata and reconstructs a vm.VM for each.
+func (p *Provider) List() (vm.List, error) {
+	client, err := p.computeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := servers.List(client, servers.ListOpts{}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	all, err := servers.ExtractServers(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret vm.List
+	for _, s := range all {
+		lifetimeStr, ok := s.Metadata[metaLifetime].(string)
+		if !ok {
+			continue
+		}
+		lifetime, _ := time.ParseDuration(lifetimeStr)
+		created, _ := time.Parse(time.RFC3339, fmt.Sprint(s.Metadata[metaCreated]))
+
+		privateIP, publicIP := addressesFromServer(s.Addresses)
+		machineType, _ := s.Flavor["id"].(string)
+
+		ret = append(ret, vm.VM{
+			Name:       s.Name,
+			CreatedAt:  created,
+			Lifetime:   lifetime,
+			Provider:   ProviderName,
+			ProviderID: s.ID,
+			PrivateIP:  privateIP,
+			PublicIP:   publicIP,
+			RemoteUser: config.DefaultSSHUser,
+			// s.Addresses is keyed by network *name*; VPC-equivalency
+			// decisions need the Neutron network UUID instead. Every
+			// roachprod VM on this provider is attached to the single
+			// configured network, so that UUID is the VPC directly.
+			VPC:         p.opts.Network,
+			MachineType: machineType,
+			// Region is set explicitly, rather than left for Locality to
+			// regex-parse out of Zone, since --openstack-availability-zone
+			// has no default and needn't follow the GCE/AWS
+			// "<region>-<letter>" convention Locality's regex expects.
+			Region:     p.opts.Region,
+			Zone:       p.opts.AvailabilityZone,
+			PowerState: powerStateFromStatus(s.Status),
+		})
+	}
+	return ret, nil
+}
+
+// addressesFromServer extracts the fixed (private) and floating (public) IP
+// from a Nova server's Addresses map, which is keyed by network name and
+// whose entries gophercloud leaves as untyped JSON.
+func addressesFromServer(addresses map[string]interface{}) (privateIP, publicIP string) {
+	for _, addrsRaw := range addresses {
+		addrs, ok := addrsRaw.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, raw := range addrs {
+			addr, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip := fmt.Sprint(addr["addr"])
+			if fmt.Sprint(addr["OS-EXT-IPS:type"]) == "floating" {
+				publicIP = ip
+			} else {
+				privateIP = ip
+			}
+		}
+	}
+	return privateIP, publicIP
+}
+
+// powerStateFromStatus translates a Nova server status into the
+// roachprod-wide vm.PowerState enum.
+func powerStateFromStatus(status string) vm.PowerState {
+	switch status {
+	case "ACTIVE":
+		return vm.PowerStateRunning
+	case "SHUTOFF":
+		return vm.PowerStateStopped
+	default:
+		return vm.PowerStateUnknown
+	}
+}
+
+// Stop implements vm.LifecycleProvider. It powers off instances without
+// deleting them, unlike Delete.
+func (p *Provider) Stop(vms vm.List) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			return errors.Wrapf(startstop.Stop(client, v.ProviderID).ExtractErr(), "stopping %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// Start implements vm.LifecycleProvider.
+func (p *Provider) Start(vms vm.List) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			return errors.Wrapf(startstop.Start(client, v.ProviderID).ExtractErr(), "starting %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// Reboot implements vm.LifecycleProvider.
+func (p *Provider) Reboot(vms vm.List) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			return errors.Wrapf(servers.Reboot(client, v.ProviderID, servers.RebootOpts{
+				Type: servers.SoftReboot,
+			}).ExtractErr(), "rebooting %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// Snapshot implements vm.LifecycleProvider. The resulting Glance image is
+// named after tag so that RestoreSnapshot can look it up again.
+func (p *Provider) Snapshot(vms vm.List, tag string) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			_, err := servers.CreateImage(client, v.ProviderID, servers.CreateImageOpts{
+				Name: fmt.Sprintf("%s-%s", v.Name, tag),
+			}).ExtractImageID()
+			return errors.Wrapf(err, "snapshotting %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// RestoreSnapshot implements vm.LifecycleProvider. It rebuilds each
+// instance from the Glance image previously captured by Snapshot under
+// tag.
+func (p *Provider) RestoreSnapshot(vms vm.List, tag string) error {
+	client, err := p.computeClient()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			imageID, err := p.findSnapshotImage(client, fmt.Sprintf("%s-%s", v.Name, tag))
+			if err != nil {
+				return errors.Wrapf(err, "finding snapshot %q for %q", tag, v.Name)
+			}
+			_, err = servers.Rebuild(client, v.ProviderID, servers.RebuildOpts{
+				ImageRef: imageID,
+			}).Extract()
+			return errors.Wrapf(err, "restoring %q to snapshot %q", v.Name, tag)
+		})
+	}
+	return g.Wait()
+}
+
+// findSnapshotImage resolves the Glance image ID for the image named name,
+// as created by Snapshot. servers.Rebuild requires an image UUID, not a
+// name, so RestoreSnapshot looks it up through this.
+func (p *Provider) findSnapshotImage(client *gophercloud.ServiceClient, name string) (string, error) {
+	pages, err := images.ListDetail(client, images.ListOpts{Name: name}).AllPages()
+	if err != nil {
+		return "", err
+	}
+	all, err := images.ExtractImages(pages)
+	if err != nil {
+		return "", err
+	}
+	if len(all) == 0 {
+		return "", errors.Errorf("no snapshot image named %q", name)
+	}
+	return all[0].ID, nil
+}
+
+// timeNow is a seam for testing.
+var timeNow = time.Now
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/cmd/roachprod/config"
+	"github.com/cockroachdb/cockroach/pkg/cmd/roachprod/vm/cloudinit"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"golang.org/x/sync/errgroup"
@@ -54,6 +55,16 @@ type VM struct {
 	VPC         string `json:"vpc"`
 	MachineType string `json:"machine_type"`
 	Zone        string `json:"zone"`
+	// Region, if set, is used by Locality in place of parsing a region out
+	// of Zone. Locality's default parsing assumes the GCE/AWS convention of
+	// a zone name ending in a single letter (e.g. "us-east1-b"); providers
+	// whose zone/availability-zone names don't follow that convention
+	// should populate Region explicitly instead.
+	Region string `json:"region,omitempty"`
+	// PowerState reports the last known power state of the VM, as surfaced
+	// by List. It is only populated by providers that implement
+	// LifecycleProvider; other providers leave it at PowerStateUnknown.
+	PowerState PowerState `json:"power_state"`
 }
 
 // Name generates the name for the i'th node in a cluster.
@@ -79,12 +90,17 @@ func (vm *VM) IsLocal() bool {
 // GCE and AWS use similarly-named regions (e.g. us-east-1)
 func (vm *VM) Locality() string {
 	var region string
-	if vm.IsLocal() {
+	switch {
+	case vm.Region != "":
+		region = vm.Region
+	case vm.IsLocal():
 		region = vm.Zone
-	} else if match := regionRE.FindStringSubmatch(vm.Zone); len(match) == 2 {
-		region = match[1]
-	} else {
-		log.Fatalf("unable to parse region from zone %q", vm.Zone)
+	default:
+		if match := regionRE.FindStringSubmatch(vm.Zone); len(match) == 2 {
+			region = match[1]
+		} else {
+			log.Fatalf("unable to parse region from zone %q", vm.Zone)
+		}
 	}
 	return fmt.Sprintf("cloud=%s,region=%s,zone=%s", vm.Provider, region, vm.Zone)
 }
@@ -114,6 +130,21 @@ func (vl List) ProviderIDs() []string {
 	return ret
 }
 
+// filterNames returns the subset of vl whose Name appears in names.
+func (vl List) filterNames(names []string) List {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	var ret List
+	for _, v := range vl {
+		if set[v.Name] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
 // CreateOpts is the set of options when creating VMs.
 type CreateOpts struct {
 	Lifetime       time.Duration
@@ -125,6 +156,38 @@ type CreateOpts struct {
 		// mounting the SSD. Ignored if UseLocalSSD is not set.
 		NoExt4Barrier bool
 	}
+	// UserData supplies cloud-init/user-data to inject at VM boot. Each
+	// Provider.Create implementation renders it via UserData.Render and
+	// passes the result through its native mechanism (GCE
+	// metadata.startup-script, AWS EC2 UserData, Azure customData,
+	// vSphere guestinfo.userdata, Nova user-data, etc).
+	UserData UserData
+	// PostCreateHook, if set, is invoked once per VM by the owning
+	// Provider's Create implementation as soon as the VM has a reachable
+	// network address (e.g. once its public/floating IP is assigned), so
+	// callers can run per-VM setup, such as installing workload binaries
+	// or applying kernel tuning, as part of Create rather than as a
+	// separate step afterwards. This tree has no dedicated
+	// SSH-ready poll loop, so "reachable address" is the closest
+	// approximation available; it fires on every Provider.Create call,
+	// not just those made through CreateCluster.
+	PostCreateHook func(vm VM) error
+}
+
+// UserData is either a raw, pre-rendered user-data script or a structured
+// cloudinit.Config. Render prefers the structured form when both are set.
+type UserData struct {
+	Raw    string
+	Config *cloudinit.Config
+}
+
+// Render returns the user-data payload a Provider should pass through to
+// the instance at boot.
+func (u UserData) Render() (string, error) {
+	if u.Config != nil {
+		return u.Config.Render()
+	}
+	return u.Raw, nil
 }
 
 // ProviderFlags is a hook point for Providers to supply additional,
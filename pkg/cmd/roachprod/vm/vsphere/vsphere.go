@@ -0,0 +1,621 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package vsphere implements the vm.Provider interface against an on-prem
+// vCenter installation. It lets roachprod target vSphere clusters the same
+// way it targets GCE or AWS.
+package vsphere
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/cmd/roachprod/config"
+	"github.com/cockroachdb/cockroach/pkg/cmd/roachprod/vm"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// ProviderName is the name associated with the vSphere vm.Provider.
+const ProviderName = "vsphere"
+
+// Custom attribute names used in lieu of the free-form tags that GCE and AWS
+// provide. Older vCenter releases only support a fixed set of custom fields,
+// so we key everything off of a small, well-known namespace.
+const (
+	attrRoachprod = "roachprod"
+	attrLifetime  = "roachprod-lifetime"
+	attrCreated   = "roachprod-created"
+)
+
+func init() {
+	vm.Providers[ProviderName] = &Provider{}
+}
+
+// providerOpts implements vm.ProviderFlags and carries the vCenter connection
+// details and cluster placement options supplied on the command line.
+type providerOpts struct {
+	URL        string
+	User       string
+	Password   string
+	Insecure   bool
+	Datacenter string
+	Cluster    string
+	Datastore  string
+	Network    string
+	Template   string
+	Folder     string
+
+	// MachineType selects the CPU/RAM a cloned VM is reconfigured to, in
+	// <cpus>vcpu-<mem>gb form (e.g. "8vcpu-32gb").
+	MachineType string
+}
+
+// Provider implements the vm.Provider interface for vSphere.
+type Provider struct {
+	opts providerOpts
+}
+
+// ConfigureCreateFlags implements vm.ProviderFlags.
+func (p *Provider) ConfigureCreateFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&p.opts.MachineType, "vsphere-machine-type", "4vcpu-16gb",
+		"CPU/RAM to reconfigure cloned VMs to, in <cpus>vcpu-<mem>gb form (e.g. 8vcpu-32gb)")
+}
+
+// ConfigureClusterFlags implements vm.ProviderFlags.
+func (p *Provider) ConfigureClusterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&p.opts.URL, "vsphere-url", "",
+		"vCenter SDK URL, e.g. https://vcenter.example.com/sdk")
+	flags.StringVar(&p.opts.User, "vsphere-user", "",
+		"vCenter username")
+	flags.StringVar(&p.opts.Password, "vsphere-password", "",
+		"vCenter password")
+	flags.BoolVar(&p.opts.Insecure, "vsphere-insecure", false,
+		"skip verification of the vCenter TLS certificate")
+	flags.StringVar(&p.opts.Datacenter, "vsphere-datacenter", "",
+		"vSphere datacenter in which to create VMs")
+	flags.StringVar(&p.opts.Cluster, "vsphere-cluster", "",
+		"vSphere compute cluster in which to create VMs")
+	flags.StringVar(&p.opts.Datastore, "vsphere-datastore", "",
+		"vSphere datastore backing the cloned VMs")
+	flags.StringVar(&p.opts.Network, "vsphere-network", "",
+		"vSphere network to attach to the cloned VMs")
+	flags.StringVar(&p.opts.Template, "vsphere-template", "",
+		"name of the template VM to clone")
+	flags.StringVar(&p.opts.Folder, "vsphere-folder", "",
+		"vSphere inventory folder in which to place the cloned VMs")
+}
+
+// Flags implements vm.Provider.
+func (p *Provider) Flags() vm.ProviderFlags {
+	return &p.opts
+}
+
+// Name implements vm.Provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// client dials the configured vCenter and returns an authenticated client.
+func (p *Provider) client(ctx context.Context) (*govmomi.Client, error) {
+	u, err := url.Parse(p.opts.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing vsphere-url %q", p.opts.URL)
+	}
+	u.User = url.UserPassword(p.opts.User, p.opts.Password)
+	return govmomi.NewClient(ctx, u, p.opts.Insecure)
+}
+
+// finder returns a find.Finder scoped to the configured datacenter.
+func (p *Provider) finder(ctx context.Context, c *govmomi.Client) (*find.Finder, error) {
+	f := find.NewFinder(c.Client, true)
+	dc, err := f.Datacenter(ctx, p.opts.Datacenter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding datacenter %q", p.opts.Datacenter)
+	}
+	f.SetDatacenter(dc)
+	return f, nil
+}
+
+// CleanSSH implements vm.Provider. vSphere VMs are reached through the same
+// SSH configuration as every other provider, so there is nothing to clean up.
+func (p *Provider) CleanSSH() error {
+	return nil
+}
+
+// ConfigSSH implements vm.Provider. vSphere VMs are reached through the same
+// SSH configuration as every other provider, so there is nothing to configure.
+func (p *Provider) ConfigSSH() error {
+	return nil
+}
+
+// Create implements vm.Provider. It clones the configured template VM once
+// per requested name, reconfigures CPU/RAM to match the requested machine
+// type, attaches the requested network, and waits for guest tools to report
+// an IP address.
+func (p *Provider) Create(names []string, opts vm.CreateOpts) error {
+	ctx := context.Background()
+	c, err := p.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	f, err := p.finder(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	template, err := f.VirtualMachine(ctx, p.opts.Template)
+	if err != nil {
+		return errors.Wrapf(err, "finding template %q", p.opts.Template)
+	}
+	folder, err := f.FolderOrDefault(ctx, p.opts.Folder)
+	if err != nil {
+		return errors.Wrapf(err, "finding folder %q", p.opts.Folder)
+	}
+	pool, err := f.ResourcePool(ctx, fmt.Sprintf("*/%s/Resources", p.opts.Cluster))
+	if err != nil {
+		return errors.Wrapf(err, "finding cluster %q", p.opts.Cluster)
+	}
+	datastore, err := f.Datastore(ctx, p.opts.Datastore)
+	if err != nil {
+		return errors.Wrapf(err, "finding datastore %q", p.opts.Datastore)
+	}
+	network, err := f.Network(ctx, p.opts.Network)
+	if err != nil {
+		return errors.Wrapf(err, "finding network %q", p.opts.Network)
+	}
+
+	// Create the custom fields up front, rather than letting each
+	// concurrent createVM call race to do it via setCustomAttribute: a
+	// fresh vCenter has none of these fields yet, and concurrent
+	// CustomFieldsManager.Add calls for the same field name race, with
+	// all but one failing "already exists".
+	for _, name := range []string{attrRoachprod, attrCreated, attrLifetime} {
+		if err := p.ensureCustomField(ctx, c, name); err != nil {
+			return err
+		}
+	}
+
+	var g errgroup.Group
+	for i := range names {
+		name := names[i]
+		g.Go(func() error {
+			return p.createVM(ctx, c, template, folder, pool, datastore, network, name, opts)
+		})
+	}
+	return g.Wait()
+}
+
+func (p *Provider) createVM(
+	ctx context.Context,
+	c *govmomi.Client,
+	template *object.VirtualMachine,
+	folder *object.Folder,
+	pool *object.ResourcePool,
+	datastore *object.Datastore,
+	network object.NetworkReference,
+	name string,
+	opts vm.CreateOpts,
+) error {
+	poolRef := pool.Reference()
+	dsRef := datastore.Reference()
+	spec := types.VirtualMachineCloneSpec{
+		Location: types.VirtualMachineRelocateSpec{
+			Pool:      &poolRef,
+			Datastore: &dsRef,
+		},
+		PowerOn: false,
+	}
+
+	task, err := template.Clone(ctx, folder, name, spec)
+	if err != nil {
+		return errors.Wrapf(err, "cloning %q", name)
+	}
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "waiting for clone of %q", name)
+	}
+	clonedVM := object.NewVirtualMachine(c.Client, info.Result.(types.ManagedObjectReference))
+
+	userData, err := opts.UserData.Render()
+	if err != nil {
+		return errors.Wrapf(err, "rendering user-data for %q", name)
+	}
+
+	cpus, memMB := p.machineSpec()
+	confSpec := types.VirtualMachineConfigSpec{
+		NumCPUs:  int32(cpus),
+		MemoryMB: int64(memMB),
+	}
+	if userData != "" {
+		confSpec.ExtraConfig = []types.BaseOptionValue{
+			&types.OptionValue{Key: "guestinfo.userdata", Value: base64.StdEncoding.EncodeToString([]byte(userData))},
+			&types.OptionValue{Key: "guestinfo.userdata.encoding", Value: "base64"},
+		}
+	}
+	if task, err = clonedVM.Reconfigure(ctx, confSpec); err != nil {
+		return errors.Wrapf(err, "reconfiguring %q", name)
+	}
+	if err = task.Wait(ctx); err != nil {
+		return errors.Wrapf(err, "reconfiguring %q", name)
+	}
+
+	devices, err := clonedVM.Device(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "fetching devices for %q", name)
+	}
+	if nics := devices.SelectByType((*types.VirtualEthernetCard)(nil)); len(nics) > 0 {
+		nic := nics[0].(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+		backing, err := network.EthernetCardBackingInfo(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "resolving network backing for %q", name)
+		}
+		nic.Backing = backing
+		if err := clonedVM.EditDevice(ctx, nics[0]); err != nil {
+			return errors.Wrapf(err, "editing network device of %q", name)
+		}
+	}
+
+	if err := p.setCustomAttribute(ctx, c, clonedVM, attrRoachprod, "true"); err != nil {
+		return err
+	}
+	if err := p.setCustomAttribute(ctx, c, clonedVM, attrCreated, timeNow().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	if err := p.setCustomAttribute(ctx, c, clonedVM, attrLifetime, opts.Lifetime.String()); err != nil {
+		return err
+	}
+
+	if task, err = clonedVM.PowerOn(ctx); err != nil {
+		return errors.Wrapf(err, "powering on %q", name)
+	}
+	if err = task.Wait(ctx); err != nil {
+		return errors.Wrapf(err, "powering on %q", name)
+	}
+
+	ip, err := clonedVM.WaitForIP(ctx, true)
+	if err != nil {
+		return errors.Wrapf(err, "waiting for IP on %q", name)
+	}
+
+	if opts.PostCreateHook != nil {
+		if err := opts.PostCreateHook(vm.VM{
+			Name:       name,
+			Provider:   ProviderName,
+			ProviderID: clonedVM.Reference().Value,
+			PrivateIP:  ip,
+			PublicIP:   ip,
+			RemoteUser: config.DefaultSSHUser,
+		}); err != nil {
+			return errors.Wrapf(err, "running post-create hook for %q", name)
+		}
+	}
+	return nil
+}
+
+// machineTypeRE parses the <cpus>vcpu-<mem>gb form of --vsphere-machine-type.
+var machineTypeRE = regexp.MustCompile(`^(\d+)vcpu-(\d+)gb$`)
+
+// machineSpec maps the configured --vsphere-machine-type to vSphere
+// CPU/RAM settings. An unparseable value falls back to 4 vCPU/16GB.
+func (p *Provider) machineSpec() (cpus int, memMB int) {
+	match := machineTypeRE.FindStringSubmatch(p.opts.MachineType)
+	if match == nil {
+		return 4, 16384
+	}
+	cpus, _ = strconv.Atoi(match[1])
+	memGB, _ := strconv.Atoi(match[2])
+	return cpus, memGB * 1024
+}
+
+// ensureCustomField creates the named custom field if it does not already
+// exist. Callers that may run concurrently (e.g. Create's per-VM fan-out)
+// must call this up front, sequentially, rather than relying on
+// setCustomAttribute's own find-or-add: concurrent Add calls for the same
+// field name race against each other.
+func (p *Provider) ensureCustomField(ctx context.Context, c *govmomi.Client, name string) error {
+	m, err := object.GetCustomFieldsManager(c.Client)
+	if err != nil {
+		return err
+	}
+	if field, err := m.Find(ctx, name); err == nil && field != nil {
+		return nil
+	}
+	if _, err := m.Add(ctx, name, "VirtualMachine", nil, nil); err != nil {
+		return errors.Wrapf(err, "creating custom field %q", name)
+	}
+	return nil
+}
+
+func (p *Provider) setCustomAttribute(
+	ctx context.Context, c *govmomi.Client, ref object.Reference, name, value string,
+) error {
+	m, err := object.GetCustomFieldsManager(c.Client)
+	if err != nil {
+		return err
+	}
+	field, err := m.Find(ctx, name)
+	if err != nil || field == nil {
+		if field, err = m.Add(ctx, name, "VirtualMachine", nil, nil); err != nil {
+			return errors.Wrapf(err, "creating custom field %q", name)
+		}
+	}
+	return m.Set(ctx, ref.Reference(), field.Key, value)
+}
+
+// Delete implements vm.Provider.
+func (p *Provider) Delete(vms vm.List) error {
+	ctx := context.Background()
+	c, err := p.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	f, err := p.finder(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			obj, err := f.VirtualMachine(ctx, v.Name)
+			if err != nil {
+				return errors.Wrapf(err, "finding %q", v.Name)
+			}
+			task, err := obj.PowerOff(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "powering off %q", v.Name)
+			}
+			// Ignore errors powering off an already-stopped VM.
+			_ = task.Wait(ctx)
+
+			task, err = obj.Destroy(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "destroying %q", v.Name)
+			}
+			return task.Wait(ctx)
+		})
+	}
+	return g.Wait()
+}
+
+// Extend implements vm.Provider.
+func (p *Provider) Extend(vms vm.List, lifetime time.Duration) error {
+	ctx := context.Background()
+	c, err := p.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	f, err := p.finder(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			obj, err := f.VirtualMachine(ctx, v.Name)
+			if err != nil {
+				return errors.Wrapf(err, "finding %q", v.Name)
+			}
+			return p.setCustomAttribute(ctx, c, obj, attrLifetime, lifetime.String())
+		})
+	}
+	return g.Wait()
+}
+
+// FindActiveAccount implements vm.Provider.
+func (p *Provider) FindActiveAccount() (string, error) {
+	return p.opts.User, nil
+}
+
+// List implements vm.Provider. It walks the datacenter's VM inventory,
+// filters to VMs tagged with the roachprod custom attribute, and
+// reconstructs a vm.VM for each.
+func (p *Provider) List() (vm.List, error) {
+	ctx := context.Background()
+	c, err := p.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout(ctx)
+
+	f, err := p.finder(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := f.VirtualMachineList(ctx, "*")
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := object.GetCustomFieldsManager(c.Client)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := m.Field(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keyToName := make(map[int32]string, len(fields))
+	for _, field := range fields {
+		keyToName[field.Key] = field.Name
+	}
+
+	pc := property.DefaultCollector(c.Client)
+	var ret vm.List
+	for _, v := range vms {
+		var mvm mo.VirtualMachine
+		if err := pc.RetrieveOne(ctx, v.Reference(), []string{"config", "guest", "customValue", "resourcePool", "runtime"}, &mvm); err != nil {
+			return nil, err
+		}
+
+		attrs := map[string]string{}
+		for _, cv := range mvm.CustomValue {
+			if csv, ok := cv.(*types.CustomFieldStringValue); ok {
+				if name, ok := keyToName[csv.Key]; ok {
+					attrs[name] = csv.Value
+				}
+			}
+		}
+		if attrs[attrRoachprod] != "true" {
+			continue
+		}
+
+		lifetime, _ := time.ParseDuration(attrs[attrLifetime])
+		created, _ := time.Parse(time.RFC3339, attrs[attrCreated])
+
+		ret = append(ret, vm.VM{
+			Name:        mvm.Config.Name,
+			CreatedAt:   created,
+			Lifetime:    lifetime,
+			DNS:         mvm.Guest.HostName,
+			Provider:    ProviderName,
+			ProviderID:  mvm.Config.Uuid,
+			PrivateIP:   mvm.Guest.IpAddress,
+			PublicIP:    mvm.Guest.IpAddress,
+			RemoteUser:  config.DefaultSSHUser,
+			VPC:         p.opts.Network,
+			MachineType: fmt.Sprintf("%d vCPU", mvm.Config.Hardware.NumCPU),
+			// Region is set explicitly, rather than left for Locality to
+			// parse out of Zone, since cluster names don't follow the
+			// GCE/AWS "<region>-<letter>" convention regionRE expects.
+			Region:     p.opts.Datacenter,
+			Zone:       p.opts.Cluster,
+			PowerState: powerStateFromVSphere(mvm.Runtime.PowerState),
+		})
+	}
+	return ret, nil
+}
+
+// powerStateFromVSphere translates a vSphere runtime power state into the
+// roachprod-wide vm.PowerState enum.
+func powerStateFromVSphere(s types.VirtualMachinePowerState) vm.PowerState {
+	switch s {
+	case types.VirtualMachinePowerStatePoweredOn:
+		return vm.PowerStateRunning
+	case types.VirtualMachinePowerStatePoweredOff:
+		return vm.PowerStateStopped
+	default:
+		return vm.PowerStateUnknown
+	}
+}
+
+// Stop implements vm.LifecycleProvider. It powers off vms without
+// destroying their disks, unlike Delete.
+func (p *Provider) Stop(vms vm.List) error {
+	return p.withEachVM(vms, func(ctx context.Context, obj *object.VirtualMachine) error {
+		task, err := obj.PowerOff(ctx)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	})
+}
+
+// Start implements vm.LifecycleProvider.
+func (p *Provider) Start(vms vm.List) error {
+	return p.withEachVM(vms, func(ctx context.Context, obj *object.VirtualMachine) error {
+		task, err := obj.PowerOn(ctx)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	})
+}
+
+// Reboot implements vm.LifecycleProvider.
+func (p *Provider) Reboot(vms vm.List) error {
+	return p.withEachVM(vms, func(ctx context.Context, obj *object.VirtualMachine) error {
+		return obj.RebootGuest(ctx)
+	})
+}
+
+// Snapshot implements vm.LifecycleProvider.
+func (p *Provider) Snapshot(vms vm.List, tag string) error {
+	return p.withEachVM(vms, func(ctx context.Context, obj *object.VirtualMachine) error {
+		task, err := obj.CreateSnapshot(ctx, tag, "created by roachprod", false, false)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	})
+}
+
+// RestoreSnapshot implements vm.LifecycleProvider.
+func (p *Provider) RestoreSnapshot(vms vm.List, tag string) error {
+	return p.withEachVM(vms, func(ctx context.Context, obj *object.VirtualMachine) error {
+		task, err := obj.RevertToSnapshot(ctx, tag, false)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	})
+}
+
+// withEachVM resolves each named VM in vms and runs action against it
+// concurrently, sharing a single vCenter session.
+func (p *Provider) withEachVM(
+	vms vm.List, action func(ctx context.Context, obj *object.VirtualMachine) error,
+) error {
+	ctx := context.Background()
+	c, err := p.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Logout(ctx)
+
+	f, err := p.finder(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	for i := range vms {
+		v := vms[i]
+		g.Go(func() error {
+			obj, err := f.VirtualMachine(ctx, v.Name)
+			if err != nil {
+				return errors.Wrapf(err, "finding %q", v.Name)
+			}
+			return errors.Wrapf(action(ctx, obj), "operating on %q", v.Name)
+		})
+	}
+	return g.Wait()
+}
+
+// timeNow is a seam for testing.
+var timeNow = time.Now